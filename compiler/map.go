@@ -10,16 +10,111 @@ import (
 	"tinygo.org/x/go-llvm"
 )
 
+// mapTypeFlag bits are packed into the flags field of a mapType descriptor
+// (see emitMapTypeDescriptor), mirroring the indirectkey/indirectvalue/
+// needkeyupdate/hashmightpanic bits upstream Go keeps on its runtime maptype.
+type mapTypeFlag uint64
+
+const (
+	mapTypeIndirectKey mapTypeFlag = 1 << iota
+	mapTypeIndirectValue
+	mapTypeNeedKeyUpdate
+	mapTypeHashMightPanic
+
+	// mapTypeIndirectThreshold is the size at or above which a key or value is
+	// stored behind a pointer in the bucket instead of inline, following the
+	// approach upstream Go took for golang.org/issue/772.
+	mapTypeIndirectThreshold = 256
+)
+
+// mapTypeDescriptorName returns the (mangled) symbol under which the shared
+// mapType descriptor for a given map type is emitted, so that every call
+// site for maps of the same type resolves to the same global.
+func mapTypeDescriptorName(mapType *types.Map) string {
+	return "runtime/hashmap.mapType:" + mapType.String()
+}
+
+// emitMapTypeDescriptor returns a pointer to the (keysize, valuesize,
+// bucketsize, keyEqual, keyHash, flags) descriptor global for a Go map type,
+// emitting it once per distinct map type and reusing it at every other call
+// site. This is what actually lets make/get/set/delete/range share one
+// descriptor per type instead of threading raw sizes through every op: the
+// descriptor is compiled-in data, not something computed again at each call.
+func (c *Compiler) emitMapTypeDescriptor(mapType *types.Map) llvm.Value {
+	name := mapTypeDescriptorName(mapType)
+	if global := c.mod.NamedGlobal(name); !global.IsNil() {
+		return global
+	}
+
+	keyType := mapType.Key().Underlying()
+	valueType := mapType.Elem().Underlying()
+	llvmKeyType := c.getLLVMType(keyType)
+	llvmValueType := c.getLLVMType(valueType)
+	keySize := c.targetData.TypeAllocSize(llvmKeyType)
+	valueSize := c.targetData.TypeAllocSize(llvmValueType)
+	ptrSize := c.targetData.TypeAllocSize(c.uintptrType)
+
+	var flags mapTypeFlag
+	if !hashmapIsBinaryKey(keyType) {
+		// Equality/hashing has to be dispatched dynamically and may panic at
+		// runtime on an uncomparable dynamic value.
+		flags |= mapTypeHashMightPanic
+	}
+	if mapTypeNeedsKeyUpdate(keyType) {
+		flags |= mapTypeNeedKeyUpdate
+	}
+	if keySize >= mapTypeIndirectThreshold {
+		flags |= mapTypeIndirectKey
+	}
+	if valueSize >= mapTypeIndirectThreshold {
+		flags |= mapTypeIndirectValue
+	}
+
+	// A bucket slot holds either the key/value inline, or just a pointer to
+	// it when the indirect flag is set, so the bucket layout stays compact
+	// regardless of how large the key/value type itself is.
+	keySlotSize := keySize
+	if flags&mapTypeIndirectKey != 0 {
+		keySlotSize = ptrSize
+	}
+	valueSlotSize := valueSize
+	if flags&mapTypeIndirectValue != 0 {
+		valueSlotSize = ptrSize
+	}
+	// 8 slots per bucket, matching the runtime bucket layout.
+	bucketSize := (keySlotSize + valueSlotSize) * 8
+
+	i8ptrType := llvm.PointerType(c.ctx.Int8Type(), 0)
+	descriptorType := c.ctx.StructType([]llvm.Type{
+		c.uintptrType,     // keysize
+		c.uintptrType,     // valuesize
+		c.uintptrType,     // bucketsize
+		i8ptrType,         // key equal fn (nil selects the default memequal/interfaceEqual path)
+		i8ptrType,         // key hash fn (nil selects the default hash path)
+		c.ctx.Int8Type(), // flags
+	}, false)
+
+	global := llvm.AddGlobal(c.mod, descriptorType, name)
+	global.SetInitializer(llvm.ConstStruct([]llvm.Value{
+		llvm.ConstInt(c.uintptrType, keySize, false),
+		llvm.ConstInt(c.uintptrType, valueSize, false),
+		llvm.ConstInt(c.uintptrType, bucketSize, false),
+		llvm.ConstNull(i8ptrType),
+		llvm.ConstNull(i8ptrType),
+		llvm.ConstInt(c.ctx.Int8Type(), uint64(flags), false),
+	}, false))
+	global.SetGlobalConstant(true)
+	// Maps of the same type may be created in different translation units;
+	// linkonce_odr lets the linker fold them back down to one definition.
+	global.SetLinkage(llvm.LinkOnceODRLinkage)
+	return global
+}
+
 // emitMakeMap creates a new map object (runtime.hashmap) by allocating and
 // initializing an appropriately sized object.
 func (c *Compiler) emitMakeMap(frame *Frame, expr *ssa.MakeMap) (llvm.Value, error) {
 	mapType := expr.Type().Underlying().(*types.Map)
-	llvmKeyType := c.getLLVMType(mapType.Key().Underlying())
-	llvmValueType := c.getLLVMType(mapType.Elem().Underlying())
-	keySize := c.targetData.TypeAllocSize(llvmKeyType)
-	valueSize := c.targetData.TypeAllocSize(llvmValueType)
-	llvmKeySize := llvm.ConstInt(c.ctx.Int8Type(), keySize, false)
-	llvmValueSize := llvm.ConstInt(c.ctx.Int8Type(), valueSize, false)
+	descriptor := c.emitMapTypeDescriptor(mapType)
 	sizeHint := llvm.ConstInt(c.uintptrType, 8, false)
 	if expr.Reserve != nil {
 		sizeHint = c.getValue(frame, expr.Reserve)
@@ -29,12 +124,68 @@ func (c *Compiler) emitMakeMap(frame *Frame, expr *ssa.MakeMap) (llvm.Value, err
 			return llvm.Value{}, err
 		}
 	}
-	hashmap := c.createRuntimeCall("hashmapMake", []llvm.Value{llvmKeySize, llvmValueSize, sizeHint}, "")
+	hashmap := c.createRuntimeCall("hashmapMake", []llvm.Value{descriptor, sizeHint}, "")
 	return hashmap, nil
 }
 
+// emitMapRange lowers *ssa.Range for a map-typed expr: it creates a
+// hashmapIterator for the map, to be consumed by repeated calls to
+// emitMapNext. The runtime snapshots the bucket count at creation and picks
+// a randomized starting bucket/offset, so two range statements over the same
+// map don't observe the same iteration order. The generic createExpr switch
+// dispatches here whenever expr.X's underlying type is *types.Map; for a
+// range over a string it uses a separate (non-map) path instead.
+func (c *Compiler) emitMapRange(frame *Frame, expr *ssa.Range) (llvm.Value, error) {
+	mapType, ok := expr.X.Type().Underlying().(*types.Map)
+	if !ok {
+		return llvm.Value{}, c.makeError(expr.Pos(), "emitMapRange called with a non-map range expression: "+expr.X.Type().String())
+	}
+	m := c.getValue(frame, expr.X)
+	descriptor := c.emitMapTypeDescriptor(mapType)
+	it := c.createRuntimeCall("hashmapNewIterator", []llvm.Value{m, descriptor}, "range.it")
+	return it, nil
+}
+
+// emitMapNext lowers *ssa.Next for an iterator produced by emitMapRange: it
+// advances the hashmapIterator and returns an (ok, key, value) tuple. It
+// tolerates deletions that happen during iteration: a deleted bucket entry
+// is simply skipped, matching the behavior of upstream Go. The generic
+// createExpr switch dispatches here when expr.IsString is false and the
+// iterator was produced by emitMapRange.
+func (c *Compiler) emitMapNext(frame *Frame, expr *ssa.Next) (llvm.Value, error) {
+	if expr.IsString {
+		return llvm.Value{}, c.makeError(expr.Pos(), "emitMapNext called with a string range expression")
+	}
+	tuple, ok := expr.Type().(*types.Tuple)
+	if !ok || tuple.Len() != 3 {
+		return llvm.Value{}, c.makeError(expr.Pos(), "could not determine key/value types of map range")
+	}
+	keyType := tuple.At(1).Type()
+	valueType := tuple.At(2).Type()
+	llvmKeyType := c.getLLVMType(keyType)
+	llvmValueType := c.getLLVMType(valueType)
+
+	it := c.getValue(frame, expr.Iter)
+	keyAlloca, keyPtr, keySize := c.createTemporaryAlloca(llvmKeyType, "range.key")
+	valueAlloca, valuePtr, valueSize := c.createTemporaryAlloca(llvmValueType, "range.value")
+
+	okValue := c.createRuntimeCall("hashmapNext", []llvm.Value{it, keyPtr, valuePtr}, "range.next")
+
+	key := c.builder.CreateLoad(keyAlloca, "")
+	value := c.builder.CreateLoad(valueAlloca, "")
+	c.emitLifetimeEnd(keyPtr, keySize)
+	c.emitLifetimeEnd(valuePtr, valueSize)
+
+	result := llvm.Undef(c.ctx.StructType([]llvm.Type{c.ctx.Int1Type(), llvmKeyType, llvmValueType}, false))
+	result = c.builder.CreateInsertValue(result, okValue, 0, "")
+	result = c.builder.CreateInsertValue(result, key, 1, "")
+	result = c.builder.CreateInsertValue(result, value, 2, "")
+	return result, nil
+}
+
 func (c *Compiler) emitMapLookup(keyType, valueType types.Type, m, key llvm.Value, commaOk bool, pos token.Pos) (llvm.Value, error) {
 	llvmValueType := c.getLLVMType(valueType)
+	descriptor := c.emitMapTypeDescriptor(types.NewMap(keyType, valueType))
 
 	// Allocate the memory for the resulting type. Do not zero this memory: it
 	// will be zeroed by the hashmap get implementation if the key is not
@@ -45,21 +196,40 @@ func (c *Compiler) emitMapLookup(keyType, valueType types.Type, m, key llvm.Valu
 	var commaOkValue llvm.Value
 	if t, ok := keyType.(*types.Basic); ok && t.Info()&types.IsString != 0 {
 		// key is a string
-		params := []llvm.Value{m, key, mapValuePtr}
+		params := []llvm.Value{m, descriptor, key, mapValuePtr}
 		commaOkValue = c.createRuntimeCall("hashmapStringGet", params, "")
 	} else if hashmapIsBinaryKey(keyType) {
 		// key can be compared with runtime.memequal
 		// Store the key in an alloca, in the entry block to avoid dynamic stack
-		// growth.
+		// growth. Unlike emitMapUpdate, this pointer never outlives the call:
+		// the runtime only reads through it to compare against whatever is
+		// already in the bucket (inline or, for an indirect key, dereferenced
+		// by the runtime itself), so it doesn't need emitIndirectStorage's
+		// heap path even when the key type is large.
 		mapKeyAlloca, mapKeyPtr, mapKeySize := c.createTemporaryAlloca(key.Type(), "hashmap.key")
 		c.builder.CreateStore(key, mapKeyAlloca)
+		// Precompute the hash here, field by field in declaration order, so
+		// hashmapBinaryGet doesn't have to pay a per-field runtime dispatch
+		// (or read struct padding) to hash a struct key itself.
+		hash := c.emitTypeHash(keyType, mapKeyAlloca, c.emitLoadHashmapSeed())
 		// Fetch the value from the hashmap.
-		params := []llvm.Value{m, mapKeyPtr, mapValuePtr}
+		params := []llvm.Value{m, descriptor, mapKeyPtr, hash, mapValuePtr}
 		commaOkValue = c.createRuntimeCall("hashmapBinaryGet", params, "")
 		c.emitLifetimeEnd(mapKeyPtr, mapKeySize)
 	} else {
-		// Not trivially comparable using memcmp.
-		return llvm.Value{}, c.makeError(pos, "only strings, bools, ints, pointers or structs of bools/ints are supported as map keys, but got: "+keyType.String())
+		// Key is not a string and not "binary" (it contains an interface, a
+		// float, a complex number or a string somewhere, or is some other
+		// non-binary type), so it isn't compared with a flat memequal: equality and
+		// hashing have to be dispatched dynamically, and may panic at runtime
+		// if a dynamic value turns out not to be comparable (e.g. an interface
+		// holding a slice). go/types has already rejected keys that are
+		// statically uncomparable, so anything reaching this branch is a
+		// comparable type that merely isn't "binary".
+		mapKeyAlloca, mapKeyPtr, mapKeySize := c.createTemporaryAlloca(key.Type(), "hashmap.key")
+		c.builder.CreateStore(key, mapKeyAlloca)
+		params := []llvm.Value{m, descriptor, mapKeyPtr, mapValuePtr}
+		commaOkValue = c.createRuntimeCall("hashmapInterfaceGet", params, "")
+		c.emitLifetimeEnd(mapKeyPtr, mapKeySize)
 	}
 
 	// Load the resulting value from the hashmap. The value is set to the zero
@@ -77,61 +247,144 @@ func (c *Compiler) emitMapLookup(keyType, valueType types.Type, m, key llvm.Valu
 	}
 }
 
-func (c *Compiler) emitMapUpdate(keyType types.Type, m, key, value llvm.Value, pos token.Pos) {
-	valueAlloca, valuePtr, valueSize := c.createTemporaryAlloca(value.Type(), "hashmap.value")
-	c.builder.CreateStore(value, valueAlloca)
+// emitIndirectStorage stores value into memory suitable for a map bucket
+// slot: a short-lived stack temporary when value fits inline (below
+// mapTypeIndirectThreshold), or heap-allocated memory when it doesn't,
+// matching the mapTypeIndirectKey/mapTypeIndirectValue flags computed in
+// emitMapTypeDescriptor. The bucket keeps the indirect pointer around after
+// this call returns, so that storage must outlive the current stack frame.
+// The returned endLifetime must be called once the pointer is no longer
+// needed; it is a no-op for heap-allocated storage.
+func (c *Compiler) emitIndirectStorage(value llvm.Value, name string) (ptr llvm.Value, endLifetime func()) {
+	size := c.targetData.TypeAllocSize(value.Type())
+	if size >= mapTypeIndirectThreshold {
+		boxed := c.createRuntimeCall("alloc", []llvm.Value{llvm.ConstInt(c.uintptrType, size, false)}, name)
+		boxed = c.builder.CreateBitCast(boxed, llvm.PointerType(value.Type(), 0), "")
+		c.builder.CreateStore(value, boxed)
+		return boxed, func() {}
+	}
+	alloca, ptr, allocaSize := c.createTemporaryAlloca(value.Type(), name)
+	c.builder.CreateStore(value, alloca)
+	return ptr, func() { c.emitLifetimeEnd(ptr, allocaSize) }
+}
+
+func (c *Compiler) emitMapUpdate(keyType, valueType types.Type, m, key, value llvm.Value, pos token.Pos) {
+	descriptor := c.emitMapTypeDescriptor(types.NewMap(keyType, valueType))
+	valuePtr, endValueLifetime := c.emitIndirectStorage(value, "hashmap.value")
 	keyType = keyType.Underlying()
 	if t, ok := keyType.(*types.Basic); ok && t.Info()&types.IsString != 0 {
 		// key is a string
-		params := []llvm.Value{m, key, valuePtr}
+		params := []llvm.Value{m, descriptor, key, valuePtr}
 		c.createRuntimeCall("hashmapStringSet", params, "")
 	} else if hashmapIsBinaryKey(keyType) {
 		// key can be compared with runtime.memequal
+		keyPtr, endKeyLifetime := c.emitIndirectStorage(key, "hashmap.key")
+		// See the comment in emitMapLookup: precompute the hash instead of
+		// making the runtime dispatch per field.
+		typedKeyPtr := c.builder.CreateBitCast(keyPtr, llvm.PointerType(key.Type(), 0), "")
+		hash := c.emitTypeHash(keyType, typedKeyPtr, c.emitLoadHashmapSeed())
+		params := []llvm.Value{m, descriptor, keyPtr, hash, valuePtr}
+		c.createRuntimeCall("hashmapBinarySet", params, "")
+		endKeyLifetime()
+	} else {
+		// See the comment in emitMapLookup: dispatch dynamically and let the
+		// runtime panic if the key turns out to be uncomparable.
 		keyAlloca, keyPtr, keySize := c.createTemporaryAlloca(key.Type(), "hashmap.key")
 		c.builder.CreateStore(key, keyAlloca)
-		params := []llvm.Value{m, keyPtr, valuePtr}
-		c.createRuntimeCall("hashmapBinarySet", params, "")
+		params := []llvm.Value{m, descriptor, keyPtr, valuePtr}
+		c.createRuntimeCall("hashmapInterfaceSet", params, "")
 		c.emitLifetimeEnd(keyPtr, keySize)
-	} else {
-		c.addError(pos, "only strings, bools, ints, pointers or structs of bools/ints are supported as map keys, but got: "+keyType.String())
 	}
-	c.emitLifetimeEnd(valuePtr, valueSize)
+	endValueLifetime()
 }
 
-func (c *Compiler) emitMapDelete(keyType types.Type, m, key llvm.Value, pos token.Pos) error {
+func (c *Compiler) emitMapDelete(keyType, valueType types.Type, m, key llvm.Value, pos token.Pos) error {
+	descriptor := c.emitMapTypeDescriptor(types.NewMap(keyType, valueType))
 	keyType = keyType.Underlying()
 	if t, ok := keyType.(*types.Basic); ok && t.Info()&types.IsString != 0 {
 		// key is a string
-		params := []llvm.Value{m, key}
+		params := []llvm.Value{m, descriptor, key}
 		c.createRuntimeCall("hashmapStringDelete", params, "")
 		return nil
 	} else if hashmapIsBinaryKey(keyType) {
 		keyAlloca, keyPtr, keySize := c.createTemporaryAlloca(key.Type(), "hashmap.key")
 		c.builder.CreateStore(key, keyAlloca)
-		params := []llvm.Value{m, keyPtr}
+		// See the comment in emitMapLookup: precompute the hash instead of
+		// making the runtime dispatch per field.
+		hash := c.emitTypeHash(keyType, keyAlloca, c.emitLoadHashmapSeed())
+		params := []llvm.Value{m, descriptor, keyPtr, hash}
 		c.createRuntimeCall("hashmapBinaryDelete", params, "")
 		c.emitLifetimeEnd(keyPtr, keySize)
 		return nil
 	} else {
-		return c.makeError(pos, "only strings, bools, ints, pointers or structs of bools/ints are supported as map keys, but got: "+keyType.String())
+		// See the comment in emitMapLookup: dispatch dynamically and let the
+		// runtime panic if the key turns out to be uncomparable.
+		keyAlloca, keyPtr, keySize := c.createTemporaryAlloca(key.Type(), "hashmap.key")
+		c.builder.CreateStore(key, keyAlloca)
+		params := []llvm.Value{m, descriptor, keyPtr}
+		c.createRuntimeCall("hashmapInterfaceDelete", params, "")
+		c.emitLifetimeEnd(keyPtr, keySize)
+		return nil
 	}
 }
 
-// Get FNV-1a hash of this string.
-//
-// https://en.wikipedia.org/wiki/Fowler%E2%80%93Noll%E2%80%93Vo_hash_function#FNV-1a_hash
-func hashmapHash(data []byte) uint32 {
-	var result uint32 = 2166136261 // FNV offset basis
-	for _, c := range data {
-		result ^= uint32(c)
-		result *= 16777619 // FNV prime
+// hashmapSeed is used only by the interpreter when it folds map literals at
+// compile time: determinism matters more than unpredictability when folding
+// constants. It must never be used as the seed for hashing emitted into a
+// compiled binary's own hashmapBinaryGet/Set/Delete calls — see
+// emitLoadHashmapSeed for that, which loads the runtime's real per-process
+// seed instead.
+const hashmapSeed uint64 = 0
+
+// hashmapSeedGlobal is the symbol of the process-wide hash seed the runtime
+// initializes once at startup (see hashmapinit in runtime/hashmap.go) and
+// mixes into every map hash computed by compiled code, so that identical
+// keys don't land in identical buckets in every TinyGo binary.
+const hashmapSeedGlobal = "runtime.hashmapSeed"
+
+// emitLoadHashmapSeed loads the per-process hash seed from hashmapSeedGlobal,
+// declaring the external runtime global on first use.
+func (c *Compiler) emitLoadHashmapSeed() llvm.Value {
+	global := c.mod.NamedGlobal(hashmapSeedGlobal)
+	if global.IsNil() {
+		global = llvm.AddGlobal(c.mod, c.ctx.Int64Type(), hashmapSeedGlobal)
+	}
+	return c.builder.CreateLoad(global, "hashmap.seed")
+}
+
+// hashmapHash computes a memhash/wyhash-style 64-bit hash of data, consuming
+// 8 bytes per round and finishing with an avalanche mix. This replaces the
+// previous fixed-basis FNV-1a, which hashed identical strings to identical
+// bucket positions in every TinyGo binary (a DoS foothold) and distributed
+// short structured keys poorly.
+func hashmapHash(data []byte, seed uint64) uint64 {
+	hash := seed ^ 0x9e3779b97f4a7c15
+	for len(data) >= 8 {
+		k := uint64(data[0]) | uint64(data[1])<<8 | uint64(data[2])<<16 | uint64(data[3])<<24 |
+			uint64(data[4])<<32 | uint64(data[5])<<40 | uint64(data[6])<<48 | uint64(data[7])<<56
+		hash ^= k
+		hash *= 0xff51afd7ed558ccd
+		hash = hash<<31 | hash>>33
+		data = data[8:]
 	}
-	return result
+	var k uint64
+	for i, b := range data {
+		k |= uint64(b) << (8 * uint(i))
+	}
+	hash ^= k
+	hash ^= uint64(len(data))
+	// Final avalanche, as in Murmur/wyhash finalizers.
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
 }
 
 // Get the topmost 8 bits of the hash, without using a special value (like 0).
-func hashmapTopHash(hash uint32) uint8 {
-	tophash := uint8(hash >> 24)
+func hashmapTopHash(hash uint64) uint8 {
+	tophash := uint8(hash >> 56)
 	if tophash < 1 {
 		// 0 means empty slot, so make it bigger.
 		tophash += 1
@@ -139,6 +392,46 @@ func hashmapTopHash(hash uint32) uint8 {
 	return tophash
 }
 
+// emitTypeHash generates specialized IR to hash a binary-comparable key type
+// in place, instead of dispatching to a generic runtime hash function per
+// field. It mixes each field of a struct in declaration order (matching
+// struct layout, so padding is never read), hashing string fields with the
+// runtime string hash (hashmapStringHash) and everything else with the
+// runtime hashmapBinaryHash over its raw bytes. keyPtr must point to a value
+// of type t; seed is the running hash accumulated so far (start with the
+// value returned by emitLoadHashmapSeed).
+func (c *Compiler) emitTypeHash(t types.Type, keyPtr, seed llvm.Value) llvm.Value {
+	switch t := t.Underlying().(type) {
+	case *types.Struct:
+		hash := seed
+		for i := 0; i < t.NumFields(); i++ {
+			fieldPtr := c.builder.CreateStructGEP(keyPtr, i, "")
+			hash = c.emitTypeHash(t.Field(i).Type(), fieldPtr, hash)
+		}
+		return hash
+	case *types.Array:
+		hash := seed
+		for i := int64(0); i < t.Len(); i++ {
+			elemPtr := c.builder.CreateGEP(keyPtr, []llvm.Value{
+				llvm.ConstInt(c.ctx.Int32Type(), 0, false),
+				llvm.ConstInt(c.ctx.Int32Type(), uint64(i), false),
+			}, "")
+			hash = c.emitTypeHash(t.Elem(), elemPtr, hash)
+		}
+		return hash
+	case *types.Basic:
+		if t.Info()&types.IsString != 0 {
+			strValue := c.builder.CreateLoad(keyPtr, "")
+			return c.createRuntimeCall("hashmapStringHash", []llvm.Value{strValue, seed}, "")
+		}
+		size := c.targetData.TypeAllocSize(c.getLLVMType(t))
+		return c.createRuntimeCall("hashmapBinaryHash", []llvm.Value{keyPtr, llvm.ConstInt(c.uintptrType, size, false), seed}, "")
+	default:
+		size := c.targetData.TypeAllocSize(c.getLLVMType(t))
+		return c.createRuntimeCall("hashmapBinaryHash", []llvm.Value{keyPtr, llvm.ConstInt(c.uintptrType, size, false), seed}, "")
+	}
+}
+
 // Returns true if this key type does not contain strings, interfaces etc., so
 // can be compared with runtime.memequal.
 func hashmapIsBinaryKey(keyType types.Type) bool {
@@ -163,3 +456,35 @@ func hashmapIsBinaryKey(keyType types.Type) bool {
 		return false
 	}
 }
+
+// mapTypeNeedsKeyUpdate reports whether overwriting an existing map entry
+// must also overwrite the stored key, matching upstream Go's
+// maptype.needkeyupdate: true for strings (an update may point at a shorter
+// backing array), floats and complex numbers (each has components that can
+// be +0/-0 or one of multiple NaN bit patterns) and interfaces (the stored
+// type word can differ even when the values compare equal), and recursively
+// for any struct/array built out of those.
+func mapTypeNeedsKeyUpdate(keyType types.Type) bool {
+	switch t := keyType.(type) {
+	case *types.Basic:
+		return t.Info()&(types.IsString|types.IsFloat|types.IsComplex) != 0
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			if mapTypeNeedsKeyUpdate(t.Field(i).Type().Underlying()) {
+				return true
+			}
+		}
+		return false
+	case *types.Array:
+		return mapTypeNeedsKeyUpdate(t.Elem().Underlying())
+	case *types.Named:
+		return mapTypeNeedsKeyUpdate(t.Underlying())
+	case *types.Pointer:
+		return false
+	default:
+		// Interfaces (and anything else not already handled above) need a
+		// key update: their dynamic type/value pair isn't covered by a flat
+		// memequal.
+		return true
+	}
+}
@@ -0,0 +1,143 @@
+package compiler
+
+import (
+	"go/types"
+	"testing"
+)
+
+func TestHashmapHash(t *testing.T) {
+	// Different seeds must hash the same bytes differently: baking in a
+	// fixed seed here would reintroduce the bucket-predictability problem
+	// this hash function exists to close.
+	a := hashmapHash([]byte("hello world"), 1)
+	b := hashmapHash([]byte("hello world"), 2)
+	if a == b {
+		t.Errorf("hashmapHash(%q, 1) == hashmapHash(%q, 2) == %d, want different seeds to hash differently", "hello world", "hello world", a)
+	}
+
+	// Different data under the same seed should (almost always) hash
+	// differently too.
+	c := hashmapHash([]byte("hello world"), 1)
+	d := hashmapHash([]byte("hello there"), 1)
+	if c == d {
+		t.Errorf("hashmapHash with different data produced the same hash: %d", c)
+	}
+
+	// The function must be deterministic: same data, same seed, same hash.
+	e := hashmapHash([]byte("hello world"), 1)
+	if c != e {
+		t.Errorf("hashmapHash is not deterministic: got %d and %d for the same input", c, e)
+	}
+
+	// Inputs of every length up to a couple of rounds shouldn't panic and
+	// shouldn't collapse to the same hash.
+	seen := map[uint64]bool{}
+	for n := 0; n < 20; n++ {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		h := hashmapHash(data, 0)
+		if seen[h] && n > 0 {
+			t.Errorf("hashmapHash collided for two different lengths, got %d", h)
+		}
+		seen[h] = true
+	}
+}
+
+func TestHashmapTopHash(t *testing.T) {
+	tests := []struct {
+		hash uint64
+		want uint8
+	}{
+		{0, 1},                  // top byte 0 must be bumped, it means "empty slot"
+		{1 << 56, 1},            // top byte 1 stays 1
+		{0xff << 56, 0xff},      // top byte 0xff stays 0xff
+		{0x42 << 56, 0x42},      // arbitrary top byte is passed through
+		{0x0001020304050607, 1}, // only the top byte matters
+	}
+	for _, tt := range tests {
+		if got := hashmapTopHash(tt.hash); got != tt.want {
+			t.Errorf("hashmapTopHash(0x%x) = %d, want %d", tt.hash, got, tt.want)
+		}
+	}
+}
+
+func TestHashmapIsBinaryKey(t *testing.T) {
+	boolType := types.Typ[types.Bool]
+	intType := types.Typ[types.Int]
+	stringType := types.Typ[types.String]
+	ptrToInt := types.NewPointer(intType)
+	ifaceType := types.NewInterfaceType(nil, nil)
+
+	tests := []struct {
+		name string
+		typ  types.Type
+		want bool
+	}{
+		{"bool", boolType, true},
+		{"int", intType, true},
+		{"string", stringType, false},
+		{"pointer", ptrToInt, true},
+		{"interface", ifaceType, false},
+		{"struct of ints", types.NewStruct([]*types.Var{
+			types.NewField(0, nil, "X", intType, false),
+			types.NewField(0, nil, "Y", boolType, false),
+		}, nil), true},
+		{"struct with a string field", types.NewStruct([]*types.Var{
+			types.NewField(0, nil, "X", intType, false),
+			types.NewField(0, nil, "S", stringType, false),
+		}, nil), false},
+		{"struct with an interface field", types.NewStruct([]*types.Var{
+			types.NewField(0, nil, "I", ifaceType, false),
+		}, nil), false},
+		{"array of ints", types.NewArray(intType, 4), true},
+		{"array of interfaces", types.NewArray(ifaceType, 4), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hashmapIsBinaryKey(tt.typ); got != tt.want {
+				t.Errorf("hashmapIsBinaryKey(%s) = %v, want %v", tt.typ, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMapTypeNeedsKeyUpdate(t *testing.T) {
+	boolType := types.Typ[types.Bool]
+	intType := types.Typ[types.Int]
+	stringType := types.Typ[types.String]
+	float64Type := types.Typ[types.Float64]
+	complex128Type := types.Typ[types.Complex128]
+	ifaceType := types.NewInterfaceType(nil, nil)
+
+	tests := []struct {
+		name string
+		typ  types.Type
+		want bool
+	}{
+		{"bool", boolType, false},
+		{"int", intType, false},
+		{"pointer", types.NewPointer(intType), false},
+		{"string", stringType, true},
+		{"float64", float64Type, true},
+		{"complex128", complex128Type, true},
+		{"interface", ifaceType, true},
+		{"struct of ints", types.NewStruct([]*types.Var{
+			types.NewField(0, nil, "X", intType, false),
+		}, nil), false},
+		{"struct with a float field", types.NewStruct([]*types.Var{
+			types.NewField(0, nil, "X", intType, false),
+			types.NewField(0, nil, "F", float64Type, false),
+		}, nil), true},
+		{"array of ints", types.NewArray(intType, 4), false},
+		{"array of strings", types.NewArray(stringType, 4), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mapTypeNeedsKeyUpdate(tt.typ); got != tt.want {
+				t.Errorf("mapTypeNeedsKeyUpdate(%s) = %v, want %v", tt.typ, got, tt.want)
+			}
+		})
+	}
+}